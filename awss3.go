@@ -0,0 +1,72 @@
+/*
+   Copyright (C) 2021-present Mirko Perillo and contributors
+
+   This file is part of gmail-downloader.
+
+   gmail-downloader is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   gmail-downloader is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with ts-converter.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+
+	"golang.org/x/net/context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// awsS3Client adapts the real aws-sdk-go-v2 S3 client to the local s3Client
+// interface that S3Sink depends on.
+type awsS3Client struct {
+	client *s3.Client
+}
+
+func newAWSS3Client(cfg aws.Config) *awsS3Client {
+	return &awsS3Client{client: s3.NewFromConfig(cfg)}
+}
+
+func (c *awsS3Client) PutObject(ctx context.Context, bucket, key string, body []byte, contentType string) error {
+	_, err := c.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String(contentType),
+	})
+	return err
+}
+
+func (c *awsS3Client) HeadObject(ctx context.Context, bucket, key string) (bool, error) {
+	_, err := c.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err == nil {
+		return true, nil
+	}
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		return false, nil
+	}
+	return false, err
+}
+
+// NewS3SinkFromConfig builds an S3Sink backed by the real aws-sdk-go-v2 S3
+// client, constructed from cfg (e.g. loaded via config.LoadDefaultConfig).
+func NewS3SinkFromConfig(cfg aws.Config, bucket string) *S3Sink {
+	return NewS3Sink(newAWSS3Client(cfg), bucket)
+}
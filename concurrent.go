@@ -0,0 +1,148 @@
+/*
+   Copyright (C) 2021-present Mirko Perillo and contributors
+
+   This file is part of gmail-downloader.
+
+   gmail-downloader is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   gmail-downloader is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with ts-converter.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+
+	"google.golang.org/api/googleapi"
+)
+
+// FetchConfig controls how aggressively messagesByLabel/downloadAttachments
+// (and friends) talk to the Gmail API. The zero value is valid: normalize
+// fills in GOMAXPROCS worker count, a quota-sized rate limiter, and a no-op
+// progress reporter.
+type FetchConfig struct {
+	Concurrency int
+	Limiter     *rate.Limiter
+	Progress    Progress
+
+	// IncludeInline includes inline attachments (e.g. images referenced by
+	// an HTML body's cid: URLs) alongside regular ones.
+	IncludeInline bool
+}
+
+func (c FetchConfig) normalize() FetchConfig {
+	if c.Concurrency <= 0 {
+		c.Concurrency = runtime.GOMAXPROCS(0)
+	}
+	if c.Limiter == nil {
+		c.Limiter = newRateLimiter(defaultQuotaUnitsPerSecond)
+	}
+	if c.Progress == nil {
+		c.Progress = noopProgress{}
+	}
+	return c
+}
+
+// defaultQuotaUnitsPerSecond matches Gmail's default per-user quota of 250
+// quota units/sec. The limiter's tokens are quota units, not calls: a
+// Messages.get or Attachments.get call costs 5 units and must be spent via
+// limiter.WaitN(ctx, messagesGetQuotaCost) rather than a single Wait.
+const defaultQuotaUnitsPerSecond = 250
+
+// messagesGetQuotaCost is the quota cost of a Messages.get or
+// Attachments.get call, per the Gmail API quota usage table.
+const messagesGetQuotaCost = 5
+
+// newRateLimiter builds a token-bucket limiter sized to stay under Gmail's
+// per-user quota.
+func newRateLimiter(quotaUnitsPerSecond int) *rate.Limiter {
+	if quotaUnitsPerSecond <= 0 {
+		quotaUnitsPerSecond = defaultQuotaUnitsPerSecond
+	}
+	return rate.NewLimiter(rate.Limit(quotaUnitsPerSecond), quotaUnitsPerSecond)
+}
+
+// Progress observes fetch/write activity so the CLI (or a test) can report
+// on it without the fetch code knowing how it's displayed.
+type Progress interface {
+	MessageFetched()
+	AttachmentWritten(bytes int64)
+}
+
+// noopProgress is used wherever the caller doesn't care to observe progress.
+type noopProgress struct{}
+
+func (noopProgress) MessageFetched()         {}
+func (noopProgress) AttachmentWritten(int64) {}
+
+// CountingProgress is a Progress that just tallies counts, useful for CLI
+// output and for assertions in tests.
+type CountingProgress struct {
+	Messages int64
+	Bytes    int64
+}
+
+func (p *CountingProgress) MessageFetched() {
+	atomic.AddInt64(&p.Messages, 1)
+}
+
+func (p *CountingProgress) AttachmentWritten(bytes int64) {
+	atomic.AddInt64(&p.Bytes, bytes)
+}
+
+const (
+	maxRetryAttempts  = 5
+	initialRetryDelay = 500 * time.Millisecond
+)
+
+// retryWithBackoff spends messagesGetQuotaCost units of limiter, then runs
+// fn, retrying with exponential backoff and jitter when fn fails with a
+// retryable (429/5xx) googleapi error.
+func retryWithBackoff(ctx context.Context, limiter *rate.Limiter, fn func() error) error {
+	delay := initialRetryDelay
+	var err error
+	for attempt := 0; attempt < maxRetryAttempts; attempt++ {
+		if err = limiter.WaitN(ctx, messagesGetQuotaCost); err != nil {
+			return err
+		}
+		if err = fn(); err == nil {
+			return nil
+		}
+		if !isRetryableError(err) {
+			return err
+		}
+		jitter := time.Duration(rand.Int63n(int64(delay)))
+		select {
+		case <-time.After(delay + jitter):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+	return err
+}
+
+func isRetryableError(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= 500
+	}
+	return false
+}
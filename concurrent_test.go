@@ -0,0 +1,102 @@
+/*
+   Copyright (C) 2021-present Mirko Perillo and contributors
+
+   This file is part of gmail-downloader.
+
+   gmail-downloader is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   gmail-downloader is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with ts-converter.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestCountingProgress(t *testing.T) {
+	p := &CountingProgress{}
+	p.MessageFetched()
+	p.MessageFetched()
+	p.AttachmentWritten(100)
+	p.AttachmentWritten(50)
+
+	if p.Messages != 2 {
+		t.Errorf("Messages = %d, want 2", p.Messages)
+	}
+	if p.Bytes != 150 {
+		t.Errorf("Bytes = %d, want 150", p.Bytes)
+	}
+}
+
+func TestRetryWithBackoffRetriesRetryableErrors(t *testing.T) {
+	limiter := rate.NewLimiter(rate.Inf, defaultQuotaUnitsPerSecond)
+	attempts := 0
+
+	err := retryWithBackoff(context.Background(), limiter, func() error {
+		attempts++
+		if attempts < 3 {
+			return &googleapi.Error{Code: http.StatusTooManyRequests}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("retryWithBackoff: %v", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("attempts = %d, want 3", attempts)
+	}
+}
+
+func TestRetryWithBackoffStopsOnNonRetryableError(t *testing.T) {
+	limiter := rate.NewLimiter(rate.Inf, defaultQuotaUnitsPerSecond)
+	attempts := 0
+
+	wantErr := &googleapi.Error{Code: http.StatusNotFound}
+	err := retryWithBackoff(context.Background(), limiter, func() error {
+		attempts++
+		return wantErr
+	})
+	if err != wantErr {
+		t.Fatalf("got err %v, want %v", err, wantErr)
+	}
+	if attempts != 1 {
+		t.Fatalf("attempts = %d, want 1 (no retry on a non-retryable error)", attempts)
+	}
+}
+
+func TestIsRetryableError(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{&googleapi.Error{Code: http.StatusTooManyRequests}, true},
+		{&googleapi.Error{Code: http.StatusInternalServerError}, true},
+		{&googleapi.Error{Code: http.StatusNotFound}, false},
+		{errStub("boom"), false},
+	}
+	for _, c := range cases {
+		if got := isRetryableError(c.err); got != c.want {
+			t.Errorf("isRetryableError(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
+
+type errStub string
+
+func (e errStub) Error() string { return string(e) }
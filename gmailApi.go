@@ -26,10 +26,13 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
+	"golang.org/x/sync/errgroup"
 	"google.golang.org/api/gmail/v1"
 
 	"encoding/base64"
@@ -39,27 +42,76 @@ import (
 const ENV_HOME_VAR = "GDOWN_HOME"
 
 type Attachment struct {
-	Id       string
-	Filename string
-	Content  []byte
-	Skip     bool
+	Id          string
+	Filename    string
+	Content     []byte
+	ContentType string
+	ContentId   string
 }
 
 // Retrieve a token, saves the token, then returns the generated client.
-func getClient(config *oauth2.Config) *http.Client {
+// If scopes differ from the scopes the cached token was issued for, the
+// cached token is discarded and a new one is requested, since a token
+// issued for a narrower scope (e.g. read-only) cannot be used to send mail.
+func getClient(config *oauth2.Config, scopes []string) *http.Client {
 	// The file token.json stores the user's access and refresh tokens, and is
 	// created automatically when the authorization flow completes for the first
 	// time.
 	home := getHomeFolder()
 	tokFile := fmt.Sprintf("%s/token.json", home)
+	scopesFile := fmt.Sprintf("%s/scopes.json", home)
+
+	if scopesChanged(scopesFile, scopes) {
+		os.Remove(tokFile)
+	}
+
 	tok, err := tokenFromFile(tokFile)
 	if err != nil {
 		tok = getTokenFromWeb(config)
 		saveToken(tokFile, tok)
 	}
+	saveScopes(scopesFile, scopes)
 	return config.Client(context.Background(), tok)
 }
 
+// scopesChanged reports whether scopes differs from the scopes recorded at
+// path by a previous run. A missing record is compared as if it held
+// gmail.GmailReadonlyScope, since a token cached without a record was issued
+// for that read-only scope; an unreadable record is treated as "no change".
+func scopesChanged(path string, scopes []string) bool {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		data, err = json.Marshal([]string{gmail.GmailReadonlyScope})
+	}
+	if err != nil {
+		return false
+	}
+	var cached []string
+	if err := json.Unmarshal(data, &cached); err != nil {
+		return true
+	}
+	if len(cached) != len(scopes) {
+		return true
+	}
+	for i, s := range cached {
+		if s != scopes[i] {
+			return true
+		}
+	}
+	return false
+}
+
+func saveScopes(path string, scopes []string) {
+	data, err := json.Marshal(scopes)
+	if err != nil {
+		log.Printf("unable to marshal scopes: %v", err)
+		return
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		log.Printf("unable to save scopes file: %v", err)
+	}
+}
+
 func getHomeFolder() string {
 	home, isSet := os.LookupEnv(ENV_HOME_VAR)
 	if !isSet {
@@ -109,21 +161,82 @@ func saveToken(path string, token *oauth2.Token) {
 	json.NewEncoder(f).Encode(token)
 }
 
-func messagesByLabel(srv *gmail.Service, labelId string) ([]*gmail.Message, error) {
-	msgs, err := srv.Users.Messages.List("me").LabelIds(labelId).MaxResults(500).Do()
-	if err != nil {
-		return nil, err
+// listOpts describes a Gmail Users.Messages.List filter. LabelId and Query can
+// be combined, matching the semantics of the Gmail API itself.
+type listOpts struct {
+	LabelId string
+	Query   string
+}
+
+// listMessages lists every message matching opts, paginating through
+// NextPageToken until the API reports no more pages, then fetches each
+// message in full across a worker pool of cfg.Concurrency goroutines rate
+// limited by cfg.Limiter. This is the dominant wall-clock cost for large
+// labels/queries, so it's the part worth parallelizing; the list calls
+// themselves stay serial since each one depends on the previous page token.
+func listMessages(srv *gmail.Service, opts listOpts, cfg FetchConfig) ([]*gmail.Message, error) {
+	cfg = cfg.normalize()
+
+	var stubs []*gmail.Message = make([]*gmail.Message, 0)
+
+	call := srv.Users.Messages.List("me").MaxResults(500)
+	if opts.LabelId != "" {
+		call = call.LabelIds(opts.LabelId)
+	}
+	if opts.Query != "" {
+		call = call.Q(opts.Query)
 	}
-	var messages []*gmail.Message = make([]*gmail.Message, 0)
 
-	for _, msg := range msgs.Messages {
-		completeMsg, err := srv.Users.Messages.Get("me", msg.Id).Do()
+	pageToken := ""
+	for {
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+		msgs, err := call.Do()
 		if err != nil {
-			return messages, err
+			return nil, err
 		}
-		messages = append(messages, completeMsg)
+		stubs = append(stubs, msgs.Messages...)
+		if msgs.NextPageToken == "" {
+			break
+		}
+		pageToken = msgs.NextPageToken
+	}
+
+	messages := make([]*gmail.Message, len(stubs))
+	g, ctx := errgroup.WithContext(context.Background())
+	sem := make(chan struct{}, cfg.Concurrency)
+	for i, stub := range stubs {
+		i, stub := i, stub
+		g.Go(func() error {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			var completeMsg *gmail.Message
+			err := retryWithBackoff(ctx, cfg.Limiter, func() error {
+				m, err := srv.Users.Messages.Get("me", stub.Id).Do()
+				if err != nil {
+					return err
+				}
+				completeMsg = m
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			messages[i] = completeMsg
+			cfg.Progress.MessageFetched()
+			return nil
+		})
 	}
-	return messages, err
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+func messagesByLabel(srv *gmail.Service, labelId string) ([]*gmail.Message, error) {
+	return listMessages(srv, listOpts{LabelId: labelId}, FetchConfig{})
 }
 
 func labelId(srv *gmail.Service, name string) (string, error) {
@@ -146,46 +259,130 @@ func decodeAttachment(encodedContent string) ([]byte, error) {
 	return base64.URLEncoding.DecodeString(encodedContent)
 }
 
-func attachments(srv *gmail.Service, mail *gmail.Message, path string, notOverwrite bool) ([]Attachment, error) {
-	user := "me"
-	attachments := make([]Attachment, 0)
-	if mail.Payload != nil {
-		for _, part := range mail.Payload.Parts {
-			if part.Body.AttachmentId != "" {
-				log.Printf("attachment filename: %v", part.Filename)
-				attachments = append(attachments, Attachment{Id: part.Body.AttachmentId, Filename: part.Filename})
-			}
+// attachmentParts walks mail's MIME tree recursively and returns every part
+// that carries an attachment, regardless of nesting depth (e.g. a
+// multipart/mixed wrapping a multipart/alternative, as forwarded mail and
+// calendar invites commonly produce). Inline parts - identified by a
+// Content-ID header, typically images referenced by an HTML body via
+// cid: URLs - are only included when includeInline is set.
+func attachmentParts(mail *gmail.Message, includeInline bool) []*gmail.MessagePart {
+	if mail.Payload == nil {
+		return nil
+	}
+	var parts []*gmail.MessagePart
+	collectAttachmentParts(mail.Payload, includeInline, &parts)
+	return parts
+}
+
+func collectAttachmentParts(part *gmail.MessagePart, includeInline bool, out *[]*gmail.MessagePart) {
+	if part.Body != nil && part.Body.AttachmentId != "" {
+		if includeInline || partHeader(part, "Content-ID") == "" {
+			*out = append(*out, part)
+		}
+	}
+	for _, child := range part.Parts {
+		collectAttachmentParts(child, includeInline, out)
+	}
+}
+
+// partHeader returns the value of the named header on part, or "" if it's
+// not present.
+func partHeader(part *gmail.MessagePart, name string) string {
+	for _, h := range part.Headers {
+		if strings.EqualFold(h.Name, name) {
+			return h.Value
 		}
+	}
+	return ""
+}
 
-		for pos, attachment := range attachments {
-			filePath := fmt.Sprintf("%v/%v", path, attachment.Filename)
-			_, err := os.Stat(filePath)
-			if err == nil && notOverwrite {
-				attachment.Skip = true
-				attachments[pos] = attachment
-				continue
-			}
-			attachmentResponse, err := srv.Users.Messages.Attachments.Get(user, mail.Id, attachment.Id).Do()
+// attachmentFilename returns a name to save part under. Gmail API parts
+// referenced only by Content-ID (inline images embedded via cid: URLs)
+// commonly have an empty Filename, so one is derived from the Content-ID,
+// falling back to the attachment ID, to avoid every such part in a message
+// colliding on the same path.
+func attachmentFilename(part *gmail.MessagePart) string {
+	if part.Filename != "" {
+		return part.Filename
+	}
+	if cid := strings.Trim(partHeader(part, "Content-ID"), "<>"); cid != "" {
+		return cid
+	}
+	return part.Body.AttachmentId
+}
+
+// fetchAndStoreAttachments fetches every attachment of mail across a worker
+// pool of cfg.Concurrency goroutines and streams each one straight to sink
+// as it arrives, rather than collecting them all in memory first. Any
+// attachment whose relPath already Exists in sink is skipped when
+// notOverwrite is set.
+func fetchAndStoreAttachments(srv *gmail.Service, mail *gmail.Message, sink AttachmentSink, dir string, notOverwrite bool, cfg FetchConfig) error {
+	cfg = cfg.normalize()
+	user := "me"
+
+	parts := attachmentParts(mail, cfg.IncludeInline)
+	g, ctx := errgroup.WithContext(context.Background())
+	sem := make(chan struct{}, cfg.Concurrency)
+	for _, part := range parts {
+		part := part
+		g.Go(func() error {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			filename := attachmentFilename(part)
+			relPath := filepath.Join(dir, filename)
+			exists, err := sink.Exists(ctx, relPath)
 			if err != nil {
-				return attachments, err
+				return err
+			}
+			if exists && notOverwrite {
+				log.Printf("notOverwrite option enabled, attachment %s already present, it should not be overwritten", relPath)
+				return nil
 			}
-			decodedContent, err := decodeAttachment(attachmentResponse.Data)
+
+			log.Printf("attachment filename: %v", filename)
+			var content []byte
+			err = retryWithBackoff(ctx, cfg.Limiter, func() error {
+				resp, err := srv.Users.Messages.Attachments.Get(user, mail.Id, part.Body.AttachmentId).Do()
+				if err != nil {
+					return err
+				}
+				decoded, err := decodeAttachment(resp.Data)
+				if err != nil {
+					return err
+				}
+				content = decoded
+				return nil
+			})
 			if err != nil {
-				return attachments, err
+				return err
 			}
-			attachment.Content = decodedContent
-			attachments[pos] = attachment
-		}
-	}
 
-	return attachments, nil
+			a := &Attachment{
+				Id:          part.Body.AttachmentId,
+				Filename:    filename,
+				Content:     content,
+				ContentType: part.MimeType,
+				ContentId:   partHeader(part, "Content-ID"),
+			}
+			if err := putAttachment(ctx, sink, relPath, a); err != nil {
+				return err
+			}
+			cfg.Progress.AttachmentWritten(int64(len(content)))
+			return nil
+		})
+	}
+	return g.Wait()
 }
 
-func writeFile(path string, a *Attachment) error {
-	return ioutil.WriteFile(path, a.Content, 0755)
-}
+// initGmailService builds a Gmail client authorized for scopes. With no
+// scopes given it defaults to read-only access, which is all the download
+// commands need; the send subsystem requests gmail.GmailSendScope instead.
+func initGmailService(scopes ...string) (*gmail.Service, error) {
+	if len(scopes) == 0 {
+		scopes = []string{gmail.GmailReadonlyScope}
+	}
 
-func initGmailService() (*gmail.Service, error) {
 	home := getHomeFolder()
 	credentialsFile := fmt.Sprintf("%s/credentials.json", home)
 	b, err := ioutil.ReadFile(credentialsFile)
@@ -193,16 +390,15 @@ func initGmailService() (*gmail.Service, error) {
 		log.Fatalf("Unable to read client secret file: %v", err)
 	}
 
-	// If modifying these scopes, delete your previously saved token.json.
-	config, err := google.ConfigFromJSON(b, gmail.GmailReadonlyScope)
+	config, err := google.ConfigFromJSON(b, scopes...)
 	if err != nil {
 		log.Fatalf("Unable to parse client secret file to config: %v", err)
 	}
-	client := getClient(config)
+	client := getClient(config, scopes)
 	return gmail.New(client)
 }
 
-func downloadByLabel(label string, path string, notOverwrite bool) {
+func downloadByLabel(label string, sink AttachmentSink, dirTmpl string, notOverwrite bool, cfg FetchConfig) {
 	srv, err := initGmailService()
 	if err != nil {
 		log.Fatalf("Unable to retrieve Gmail client: %v", err)
@@ -213,25 +409,45 @@ func downloadByLabel(label string, path string, notOverwrite bool) {
 		log.Fatal(err)
 	}
 
-	messages, err := messagesByLabel(srv, labelId)
+	messages, err := listMessages(srv, listOpts{LabelId: labelId}, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	downloadAttachments(srv, messages, sink, dirTmpl, notOverwrite, cfg)
+}
+
+// downloadByQuery downloads the attachments of every message matching a
+// Gmail search query (the same syntax accepted by the Gmail UI's search box,
+// e.g. "from:alice@example.com has:attachment after:2021/01/01").
+func downloadByQuery(query string, sink AttachmentSink, dirTmpl string, notOverwrite bool, cfg FetchConfig) {
+	srv, err := initGmailService()
+	if err != nil {
+		log.Fatalf("Unable to retrieve Gmail client: %v", err)
+	}
+
+	messages, err := listMessages(srv, listOpts{Query: query}, cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	downloadAttachments(srv, messages, sink, dirTmpl, notOverwrite, cfg)
+}
+
+// downloadAttachments saves the attachments of messages to sink, fetching
+// each message's attachments through the cfg worker pool. dirTmpl, if
+// non-empty, is a text/template expanded per message (e.g.
+// "{{.From}}/{{.Date.Format \"2006-01\"}}") to compute a sub-directory under
+// which that message's attachments are stored.
+func downloadAttachments(srv *gmail.Service, messages []*gmail.Message, sink AttachmentSink, dirTmpl string, notOverwrite bool, cfg FetchConfig) {
 	for _, m := range messages {
-		attachments, err := attachments(srv, m, path, notOverwrite)
+		dir, err := expandDirTemplate(dirTmpl, m)
 		if err != nil {
 			log.Fatal(err)
 		}
-		for _, a := range attachments {
-			if a.Skip {
-				log.Printf("notOverwrite option enabled, attachment %s already present, it should not be overwritten", fmt.Sprintf("%v/%v", path, a.Filename))
-			} else {
-				err = writeFile(fmt.Sprintf("%v/%v", path, a.Filename), &a)
-				if err != nil {
-					log.Fatal(err)
-				}
-			}
+
+		if err := fetchAndStoreAttachments(srv, m, sink, dir, notOverwrite, cfg); err != nil {
+			log.Fatal(err)
 		}
 	}
 }
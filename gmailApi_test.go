@@ -0,0 +1,139 @@
+/*
+   Copyright (C) 2021-present Mirko Perillo and contributors
+
+   This file is part of gmail-downloader.
+
+   gmail-downloader is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   gmail-downloader is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with ts-converter.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// fakeGmailServer serves just enough of Users.Messages.List/Get for
+// listMessages: two pages of stubs, then the full message for each.
+func fakeGmailServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	pages := []gmail.ListMessagesResponse{
+		{Messages: []*gmail.Message{{Id: "m1"}, {Id: "m2"}}, NextPageToken: "page2"},
+		{Messages: []*gmail.Message{{Id: "m3"}}},
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.URL.Path, "/messages") {
+			http.NotFound(w, r)
+			return
+		}
+		if id := strings.TrimPrefix(r.URL.Path, "/gmail/v1/users/me/messages/"); id != r.URL.Path {
+			json.NewEncoder(w).Encode(&gmail.Message{Id: id})
+			return
+		}
+		page := 0
+		if r.URL.Query().Get("pageToken") == "page2" {
+			page = 1
+		}
+		json.NewEncoder(w).Encode(pages[page])
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestListMessagesPaginates(t *testing.T) {
+	srv := fakeGmailServer(t)
+	gsrv, err := gmail.New(srv.Client())
+	if err != nil {
+		t.Fatalf("gmail.New: %v", err)
+	}
+	gsrv.BasePath = srv.URL
+
+	messages, err := listMessages(gsrv, listOpts{}, FetchConfig{})
+	if err != nil {
+		t.Fatalf("listMessages: %v", err)
+	}
+
+	gotIds := make(map[string]bool)
+	for _, m := range messages {
+		gotIds[m.Id] = true
+	}
+	if len(messages) != 3 || !gotIds["m1"] || !gotIds["m2"] || !gotIds["m3"] {
+		t.Fatalf("listMessages returned %+v, want messages m1, m2, m3 across both pages", messages)
+	}
+}
+
+func TestAttachmentPartsWalksNestedMultipart(t *testing.T) {
+	mail := &gmail.Message{
+		Payload: &gmail.MessagePart{
+			MimeType: "multipart/mixed",
+			Parts: []*gmail.MessagePart{
+				{
+					MimeType: "multipart/alternative",
+					Parts: []*gmail.MessagePart{
+						{MimeType: "text/plain", Body: &gmail.MessagePartBody{}},
+						{MimeType: "text/html", Body: &gmail.MessagePartBody{}},
+					},
+				},
+				{
+					MimeType: "application/pdf",
+					Filename: "report.pdf",
+					Body:     &gmail.MessagePartBody{AttachmentId: "att1"},
+				},
+			},
+		},
+	}
+
+	parts := attachmentParts(mail, false)
+	if len(parts) != 1 || parts[0].Body.AttachmentId != "att1" {
+		t.Fatalf("attachmentParts = %+v, want the single nested attachment part", parts)
+	}
+}
+
+func TestAttachmentPartsExcludesInlineUnlessRequested(t *testing.T) {
+	mail := &gmail.Message{
+		Payload: &gmail.MessagePart{
+			MimeType: "multipart/mixed",
+			Parts: []*gmail.MessagePart{
+				{
+					MimeType: "image/png",
+					Body:     &gmail.MessagePartBody{AttachmentId: "inline1"},
+					Headers: []*gmail.MessagePartHeader{
+						{Name: "Content-ID", Value: "<logo>"},
+					},
+				},
+				{
+					MimeType: "application/pdf",
+					Filename: "report.pdf",
+					Body:     &gmail.MessagePartBody{AttachmentId: "att1"},
+				},
+			},
+		},
+	}
+
+	parts := attachmentParts(mail, false)
+	if len(parts) != 1 || parts[0].Body.AttachmentId != "att1" {
+		t.Fatalf("attachmentParts(includeInline=false) = %+v, want only the non-inline attachment", parts)
+	}
+
+	parts = attachmentParts(mail, true)
+	if len(parts) != 2 {
+		t.Fatalf("attachmentParts(includeInline=true) = %+v, want both parts", parts)
+	}
+}
@@ -0,0 +1,231 @@
+/*
+   Copyright (C) 2021-present Mirko Perillo and contributors
+
+   This file is part of gmail-downloader.
+
+   gmail-downloader is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   gmail-downloader is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with ts-converter.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net/http"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// Message is the content of an outgoing email, built into a raw RFC 2822
+// message by encodeRaw before being handed to the Gmail API.
+type Message struct {
+	From        string
+	To          []string
+	Cc          []string
+	Bcc         []string
+	Subject     string
+	BodyText    string
+	BodyHTML    string
+	Attachments []Attachment
+}
+
+const mixedBoundary = "gmail-downloader-mixed-boundary"
+const altBoundary = "gmail-downloader-alt-boundary"
+
+// encodeRaw builds a compliant RFC 2822 message from m: headers terminated
+// by CRLF, a blank CRLF line before the body, and a multipart/mixed envelope
+// (with a nested multipart/alternative for text+HTML) whenever attachments
+// are present.
+func encodeRaw(m Message) (string, error) {
+	var buf bytes.Buffer
+
+	hasAttachments := len(m.Attachments) > 0
+	hasAlternative := m.BodyText != "" && m.BodyHTML != ""
+
+	writeRawHeader(&buf, "From", encodeAddress(m.From))
+	writeRawHeader(&buf, "To", encodeAddressList(m.To))
+	if len(m.Cc) > 0 {
+		writeRawHeader(&buf, "Cc", encodeAddressList(m.Cc))
+	}
+	if len(m.Bcc) > 0 {
+		writeRawHeader(&buf, "Bcc", encodeAddressList(m.Bcc))
+	}
+	writeHeader(&buf, "Subject", m.Subject)
+	writeHeader(&buf, "MIME-Version", "1.0")
+
+	switch {
+	case hasAttachments:
+		fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mixedBoundary)
+		fmt.Fprintf(&buf, "--%s\r\n", mixedBoundary)
+		if err := writeBody(&buf, m, hasAlternative); err != nil {
+			return "", err
+		}
+		for _, a := range m.Attachments {
+			fmt.Fprintf(&buf, "\r\n--%s\r\n", mixedBoundary)
+			writeAttachmentPart(&buf, a)
+		}
+		fmt.Fprintf(&buf, "\r\n--%s--\r\n", mixedBoundary)
+	default:
+		if err := writeBody(&buf, m, hasAlternative); err != nil {
+			return "", err
+		}
+	}
+
+	return base64.URLEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// writeBody writes the text/HTML part(s) of the message. When both a text
+// and an HTML body are present they are wrapped in a multipart/alternative
+// sub-part, as required by RFC 2046.
+func writeBody(buf *bytes.Buffer, m Message, hasAlternative bool) error {
+	switch {
+	case hasAlternative:
+		fmt.Fprintf(buf, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", altBoundary)
+		fmt.Fprintf(buf, "--%s\r\n", altBoundary)
+		if err := writeTextPart(buf, "text/plain", m.BodyText); err != nil {
+			return err
+		}
+		fmt.Fprintf(buf, "\r\n--%s\r\n", altBoundary)
+		if err := writeTextPart(buf, "text/html", m.BodyHTML); err != nil {
+			return err
+		}
+		fmt.Fprintf(buf, "\r\n--%s--\r\n", altBoundary)
+	case m.BodyHTML != "":
+		return writeTextPart(buf, "text/html", m.BodyHTML)
+	default:
+		return writeTextPart(buf, "text/plain", m.BodyText)
+	}
+	return nil
+}
+
+// writeTextPart writes a text/plain or text/html body part. ASCII bodies go
+// out as 7bit, the implicit default; non-ASCII bodies are quoted-printable
+// encoded, since the Gmail API otherwise transmits them as raw 8-bit data
+// under that same implicit 7bit encoding.
+func writeTextPart(buf *bytes.Buffer, contentType, body string) error {
+	if isASCII(body) {
+		fmt.Fprintf(buf, "Content-Type: %s; charset=\"UTF-8\"\r\n\r\n", contentType)
+		buf.WriteString(body)
+		return nil
+	}
+
+	fmt.Fprintf(buf, "Content-Type: %s; charset=\"UTF-8\"\r\n", contentType)
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	w := quotedprintable.NewWriter(buf)
+	if _, err := w.Write([]byte(body)); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func writeAttachmentPart(buf *bytes.Buffer, a Attachment) {
+	contentType := http.DetectContentType(a.Content)
+	fmt.Fprintf(buf, "Content-Type: %s\r\n", contentType)
+	buf.WriteString("Content-Transfer-Encoding: base64\r\n")
+	fmt.Fprintf(buf, "Content-Disposition: attachment; filename=\"%s\"\r\n\r\n", a.Filename)
+	// Base64 lines are wrapped at 76 characters, the RFC 2045 limit, which
+	// also keeps them under RFC 2822's 998-character line limit.
+	encoded := base64.StdEncoding.EncodeToString(a.Content)
+	for len(encoded) > 76 {
+		buf.WriteString(encoded[:76])
+		buf.WriteString("\r\n")
+		encoded = encoded[76:]
+	}
+	buf.WriteString(encoded)
+	buf.WriteString("\r\n")
+}
+
+// writeHeader writes a single RFC 2822 unstructured header (e.g. Subject),
+// encoding its value per RFC 2047 when it contains non-ASCII characters.
+func writeHeader(buf *bytes.Buffer, name, value string) {
+	fmt.Fprintf(buf, "%s: %s\r\n", name, encodeHeader(value))
+}
+
+// writeRawHeader writes a header whose value has already been through any
+// RFC 2047 encoding it needs, e.g. an address list from encodeAddressList.
+// Unlike writeHeader it never re-encodes value.
+func writeRawHeader(buf *bytes.Buffer, name, value string) {
+	fmt.Fprintf(buf, "%s: %s\r\n", name, value)
+}
+
+func encodeHeader(value string) string {
+	if isASCII(value) {
+		return value
+	}
+	return mime.BEncoding.Encode("UTF-8", value)
+}
+
+// encodeAddressList RFC 2047-encodes the display-name phrase of each
+// address in addrs, leaving the addr-spec (the <...> part, or the bare
+// address when there's no display name) untouched, and joins them for a
+// To/Cc/Bcc header.
+func encodeAddressList(addrs []string) string {
+	encoded := make([]string, len(addrs))
+	for i, a := range addrs {
+		encoded[i] = encodeAddress(a)
+	}
+	return strings.Join(encoded, ", ")
+}
+
+// encodeAddress RFC 2047-encodes the display-name phrase of a single
+// "Display Name <addr@host>" (or bare "addr@host") address, since encoding
+// the whole header value - as writeHeader does for unstructured headers -
+// would wrap the addr-spec itself in an encoded-word and make the header
+// unparseable.
+func encodeAddress(addr string) string {
+	addr = strings.TrimSpace(addr)
+	idx := strings.LastIndex(addr, "<")
+	if idx == -1 || !strings.HasSuffix(addr, ">") {
+		return addr
+	}
+
+	name := strings.Trim(strings.TrimSpace(addr[:idx]), `"`)
+	addrSpec := addr[idx:]
+	if name == "" {
+		return addrSpec
+	}
+	return fmt.Sprintf("%s %s", encodeHeader(name), addrSpec)
+}
+
+func isASCII(s string) bool {
+	for _, r := range s {
+		if r > 127 {
+			return false
+		}
+	}
+	return true
+}
+
+// sendMail composes m and sends it through the Gmail API under the
+// gmail.GmailSendScope, which widens the OAuth scope beyond the read-only
+// access the download commands use.
+func sendMail(m Message) error {
+	srv, err := initGmailService(gmail.GmailSendScope)
+	if err != nil {
+		log.Fatalf("Unable to retrieve Gmail client: %v", err)
+	}
+
+	raw, err := encodeRaw(m)
+	if err != nil {
+		return err
+	}
+
+	_, err = srv.Users.Messages.Send("me", &gmail.Message{Raw: raw}).Do()
+	return err
+}
@@ -0,0 +1,202 @@
+/*
+   Copyright (C) 2021-present Mirko Perillo and contributors
+
+   This file is part of gmail-downloader.
+
+   gmail-downloader is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   gmail-downloader is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with ts-converter.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"mime"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+// decodeRaw base64-URL-decodes the Raw field encodeRaw produces and parses
+// it as an RFC 2822 message, the same way a real mail client would.
+func decodeRaw(t *testing.T, raw string) *mail.Message {
+	t.Helper()
+	data, err := base64.URLEncoding.DecodeString(raw)
+	if err != nil {
+		t.Fatalf("raw message is not base64url: %v", err)
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(string(data)))
+	if err != nil {
+		t.Fatalf("raw message is not a valid RFC 2822 message: %v\n---\n%s", err, data)
+	}
+	return msg
+}
+
+func readBody(t *testing.T, msg *mail.Message) string {
+	t.Helper()
+	data, err := io.ReadAll(msg.Body)
+	if err != nil {
+		t.Fatalf("reading body: %v", err)
+	}
+	return string(data)
+}
+
+func TestEncodeRawPlainText(t *testing.T) {
+	raw, err := encodeRaw(Message{
+		From:     "alice@example.com",
+		To:       []string{"bob@example.com"},
+		Subject:  "hello",
+		BodyText: "hi there",
+	})
+	if err != nil {
+		t.Fatalf("encodeRaw: %v", err)
+	}
+
+	msg := decodeRaw(t, raw)
+	if got := msg.Header.Get("Subject"); got != "hello" {
+		t.Errorf("Subject = %q, want %q", got, "hello")
+	}
+	if got := msg.Header.Get("Content-Type"); !strings.HasPrefix(got, "text/plain") {
+		t.Errorf("Content-Type = %q, want text/plain", got)
+	}
+	if got := readBody(t, msg); strings.TrimRight(got, "\r\n") != "hi there" {
+		t.Errorf("body = %q, want %q", got, "hi there")
+	}
+}
+
+func TestEncodeRawTextAndHTMLAlternative(t *testing.T) {
+	raw, err := encodeRaw(Message{
+		From:     "alice@example.com",
+		To:       []string{"bob@example.com"},
+		Subject:  "hello",
+		BodyText: "plain body",
+		BodyHTML: "<p>html body</p>",
+	})
+	if err != nil {
+		t.Fatalf("encodeRaw: %v", err)
+	}
+
+	msg := decodeRaw(t, raw)
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("parsing top-level Content-Type: %v", err)
+	}
+	if mediaType != "multipart/alternative" {
+		t.Fatalf("top-level Content-Type = %q, want multipart/alternative", mediaType)
+	}
+	body := readBody(t, msg)
+	if !strings.Contains(body, "--"+params["boundary"]) {
+		t.Fatalf("body doesn't reference its own boundary %q:\n%s", params["boundary"], body)
+	}
+	if !strings.Contains(body, "plain body") || !strings.Contains(body, "<p>html body</p>") {
+		t.Fatalf("body missing text or HTML part:\n%s", body)
+	}
+}
+
+func TestEncodeRawWithAttachment(t *testing.T) {
+	raw, err := encodeRaw(Message{
+		From:     "alice@example.com",
+		To:       []string{"bob@example.com"},
+		Subject:  "hello",
+		BodyText: "see attached",
+		Attachments: []Attachment{
+			{Filename: "report.txt", Content: []byte("report contents")},
+		},
+	})
+	if err != nil {
+		t.Fatalf("encodeRaw: %v", err)
+	}
+
+	msg := decodeRaw(t, raw)
+	mediaType, _, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("parsing top-level Content-Type: %v", err)
+	}
+	if mediaType != "multipart/mixed" {
+		t.Fatalf("top-level Content-Type = %q, want multipart/mixed", mediaType)
+	}
+	body := readBody(t, msg)
+	if !strings.Contains(body, "see attached") {
+		t.Fatalf("body missing text part:\n%s", body)
+	}
+	if !strings.Contains(body, `filename="report.txt"`) {
+		t.Fatalf("body missing attachment part:\n%s", body)
+	}
+	wantContent := base64.StdEncoding.EncodeToString([]byte("report contents"))
+	if !strings.Contains(body, wantContent) {
+		t.Fatalf("body missing base64 attachment content %q:\n%s", wantContent, body)
+	}
+}
+
+func TestEncodeRawEncodesNonASCIISubjectAndDisplayName(t *testing.T) {
+	raw, err := encodeRaw(Message{
+		From:     `Zoë Müller <zoe@example.com>`,
+		To:       []string{"bob@example.com"},
+		Subject:  "Café meeting",
+		BodyText: "hi",
+	})
+	if err != nil {
+		t.Fatalf("encodeRaw: %v", err)
+	}
+
+	msg := decodeRaw(t, raw)
+	wd := new(mime.WordDecoder)
+
+	subject, err := wd.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		t.Fatalf("decoding Subject: %v", err)
+	}
+	if subject != "Café meeting" {
+		t.Errorf("Subject decoded = %q, want %q", subject, "Café meeting")
+	}
+
+	from := msg.Header.Get("From")
+	if !strings.Contains(from, "<zoe@example.com>") {
+		t.Fatalf("From addr-spec was mangled: %q", from)
+	}
+	addr, err := mail.ParseAddress(from)
+	if err != nil {
+		t.Fatalf("From is not a parseable address: %v\nraw: %q", err, from)
+	}
+	if addr.Address != "zoe@example.com" {
+		t.Errorf("From address = %q, want %q", addr.Address, "zoe@example.com")
+	}
+	if addr.Name != "Zoë Müller" {
+		t.Errorf("From display name = %q, want %q", addr.Name, "Zoë Müller")
+	}
+}
+
+func TestEncodeRawNonASCIIBodyIsQuotedPrintable(t *testing.T) {
+	raw, err := encodeRaw(Message{
+		From:     "alice@example.com",
+		To:       []string{"bob@example.com"},
+		Subject:  "hello",
+		BodyText: "café",
+	})
+	if err != nil {
+		t.Fatalf("encodeRaw: %v", err)
+	}
+
+	msg := decodeRaw(t, raw)
+	if got := msg.Header.Get("Content-Transfer-Encoding"); got != "quoted-printable" {
+		t.Fatalf("Content-Transfer-Encoding = %q, want quoted-printable", got)
+	}
+	body := readBody(t, msg)
+	if strings.Contains(body, "café") {
+		t.Fatalf("non-ASCII body was written raw instead of quoted-printable encoded:\n%q", body)
+	}
+	if !strings.Contains(body, "caf=C3=A9") {
+		t.Fatalf("body isn't quoted-printable encoded as expected:\n%q", body)
+	}
+}
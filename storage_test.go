@@ -0,0 +1,245 @@
+/*
+   Copyright (C) 2021-present Mirko Perillo and contributors
+
+   This file is part of gmail-downloader.
+
+   gmail-downloader is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   gmail-downloader is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with ts-converter.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"archive/zip"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestFSSinkPutAndExists(t *testing.T) {
+	ctx := context.Background()
+	sink := NewFSSink(t.TempDir())
+	a := &Attachment{Filename: "report.pdf", Content: []byte("hello")}
+
+	exists, err := sink.Exists(ctx, "sub/report.pdf")
+	if err != nil {
+		t.Fatalf("Exists before Put: %v", err)
+	}
+	if exists {
+		t.Fatal("Exists reported true before anything was written")
+	}
+
+	if err := sink.Put(ctx, "sub/report.pdf", a); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	exists, err = sink.Exists(ctx, "sub/report.pdf")
+	if err != nil {
+		t.Fatalf("Exists after Put: %v", err)
+	}
+	if !exists {
+		t.Fatal("Exists reported false after Put")
+	}
+}
+
+func TestFSSinkRejectsEscapingRelPath(t *testing.T) {
+	ctx := context.Background()
+	sink := NewFSSink(t.TempDir())
+	a := &Attachment{Filename: "report.pdf", Content: []byte("hello")}
+
+	if err := sink.Put(ctx, "../../etc/report.pdf", a); err == nil {
+		t.Fatal("Put accepted a relPath that escapes BasePath")
+	}
+	if _, err := sink.Exists(ctx, "../../etc/report.pdf"); err == nil {
+		t.Fatal("Exists accepted a relPath that escapes BasePath")
+	}
+}
+
+func TestSanitizePathSegmentNeutralizesDotSegments(t *testing.T) {
+	cases := map[string]string{
+		".":    "_",
+		"..":   "__",
+		"...":  "...",
+		"a..b": "a..b",
+	}
+	for in, want := range cases {
+		if got := sanitizePathSegment(in); got != want {
+			t.Errorf("sanitizePathSegment(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// fakeS3Client is the fake the request asked S3Sink to be testable against.
+type fakeS3Client struct {
+	objects map[string][]byte
+}
+
+func newFakeS3Client() *fakeS3Client {
+	return &fakeS3Client{objects: make(map[string][]byte)}
+}
+
+func (c *fakeS3Client) PutObject(ctx context.Context, bucket, key string, body []byte, contentType string) error {
+	c.objects[bucket+"/"+key] = body
+	return nil
+}
+
+func (c *fakeS3Client) HeadObject(ctx context.Context, bucket, key string) (bool, error) {
+	_, ok := c.objects[bucket+"/"+key]
+	return ok, nil
+}
+
+func TestS3SinkPutAndExists(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeS3Client()
+	sink := NewS3Sink(client, "attachments")
+
+	exists, err := sink.Exists(ctx, "report.pdf")
+	if err != nil {
+		t.Fatalf("Exists before Put: %v", err)
+	}
+	if exists {
+		t.Fatal("Exists reported true before anything was uploaded")
+	}
+
+	a := &Attachment{Filename: "report.pdf", Content: []byte("hello")}
+	if err := sink.Put(ctx, "report.pdf", a); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	exists, err = sink.Exists(ctx, "report.pdf")
+	if err != nil {
+		t.Fatalf("Exists after Put: %v", err)
+	}
+	if !exists {
+		t.Fatal("Exists reported false after Put")
+	}
+}
+
+func TestZipSinkWritesEntries(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "attachments.zip")
+
+	sink, err := NewZipSink(path)
+	if err != nil {
+		t.Fatalf("NewZipSink: %v", err)
+	}
+
+	if err := sink.Put(ctx, "a/report.pdf", &Attachment{Content: []byte("hello")}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	exists, err := sink.Exists(ctx, "a/report.pdf")
+	if err != nil {
+		t.Fatalf("Exists: %v", err)
+	}
+	if !exists {
+		t.Fatal("Exists reported false right after Put")
+	}
+
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatalf("zip.OpenReader: %v", err)
+	}
+	defer r.Close()
+	if len(r.File) != 1 || r.File[0].Name != "a/report.pdf" {
+		t.Fatalf("unexpected zip contents: %+v", r.File)
+	}
+	f, err := r.File[0].Open()
+	if err != nil {
+		t.Fatalf("opening zip entry: %v", err)
+	}
+	defer f.Close()
+	content, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("reading zip entry: %v", err)
+	}
+	if string(content) != "hello" {
+		t.Fatalf("got %q, want %q", content, "hello")
+	}
+}
+
+func TestExpandDirTemplate(t *testing.T) {
+	mail := &gmail.Message{
+		Payload: &gmail.MessagePart{
+			Headers: []*gmail.MessagePartHeader{
+				{Name: "From", Value: "Alice/Example <alice@example.com>"},
+				{Name: "Date", Value: "Mon, 02 Jan 2021 15:04:05 +0000"},
+			},
+		},
+	}
+
+	dir, err := expandDirTemplate(`{{.From}}/{{.Date.Format "2006-01"}}`, mail)
+	if err != nil {
+		t.Fatalf("expandDirTemplate: %v", err)
+	}
+	want := "Alice_Example <alice@example.com>/2021-01"
+	if dir != want {
+		t.Fatalf("got %q, want %q", dir, want)
+	}
+}
+
+func TestExpandDirTemplateEmpty(t *testing.T) {
+	dir, err := expandDirTemplate("", &gmail.Message{})
+	if err != nil {
+		t.Fatalf("expandDirTemplate: %v", err)
+	}
+	if dir != "" {
+		t.Fatalf("got %q, want empty string", dir)
+	}
+}
+
+// TestExpandDirTemplateNeutralizesPathTraversal guards against a malicious
+// sender using a Subject/From of ".." to expand into a dir that escapes
+// BasePath once joined and cleaned.
+func TestExpandDirTemplateNeutralizesPathTraversal(t *testing.T) {
+	mail := &gmail.Message{
+		Payload: &gmail.MessagePart{
+			Headers: []*gmail.MessagePartHeader{
+				{Name: "From", Value: ".."},
+				{Name: "Subject", Value: ".."},
+			},
+		},
+	}
+
+	dir, err := expandDirTemplate("{{.From}}/{{.Subject}}", mail)
+	if err != nil {
+		t.Fatalf("expandDirTemplate: %v", err)
+	}
+
+	base := t.TempDir()
+	ctx := context.Background()
+	sink := NewFSSink(base)
+	relPath := filepath.Join(dir, "report.pdf")
+	if err := sink.Put(ctx, relPath, &Attachment{Content: []byte("hello")}); err != nil {
+		t.Fatalf("Put(%q): %v", relPath, err)
+	}
+
+	full, err := filepath.Abs(filepath.Join(base, relPath))
+	if err != nil {
+		t.Fatalf("filepath.Abs: %v", err)
+	}
+	absBase, err := filepath.Abs(base)
+	if err != nil {
+		t.Fatalf("filepath.Abs: %v", err)
+	}
+	if !strings.HasPrefix(full, absBase+string(filepath.Separator)) {
+		t.Fatalf("attachment written to %q, outside of BasePath %q", full, absBase)
+	}
+}
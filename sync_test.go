@@ -0,0 +1,218 @@
+/*
+   Copyright (C) 2021-present Mirko Perillo and contributors
+
+   This file is part of gmail-downloader.
+
+   gmail-downloader is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   gmail-downloader is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with ts-converter.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// newFakeGmailService builds a *gmail.Service whose requests are served by
+// handler instead of the real Gmail API.
+func newFakeGmailService(t *testing.T, handler http.HandlerFunc) *gmail.Service {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	gsrv, err := gmail.New(srv.Client())
+	if err != nil {
+		t.Fatalf("gmail.New: %v", err)
+	}
+	gsrv.BasePath = srv.URL
+	return gsrv
+}
+
+func TestFullSyncRecordsHistoryId(t *testing.T) {
+	srv := newFakeGmailService(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/profile"):
+			json.NewEncoder(w).Encode(&gmail.Profile{HistoryId: 42})
+		case strings.HasSuffix(r.URL.Path, "/messages"):
+			json.NewEncoder(w).Encode(&gmail.ListMessagesResponse{Messages: []*gmail.Message{{Id: "m1"}}})
+		case strings.HasSuffix(r.URL.Path, "/messages/m1"):
+			json.NewEncoder(w).Encode(&gmail.Message{Id: "m1"})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	state := &syncState{MessageIds: make(map[string]bool)}
+	messages, err := fullSync(srv, listOpts{}, state, FetchConfig{})
+	if err != nil {
+		t.Fatalf("fullSync: %v", err)
+	}
+	if len(messages) != 1 || messages[0].Id != "m1" {
+		t.Fatalf("fullSync messages = %+v, want [m1]", messages)
+	}
+	if state.HistoryId != 42 {
+		t.Fatalf("state.HistoryId = %d, want 42", state.HistoryId)
+	}
+}
+
+func TestIncrementalSyncDedupsMessagesAddedAcrossPages(t *testing.T) {
+	srv := newFakeGmailService(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/history"):
+			if r.URL.Query().Get("pageToken") == "" {
+				json.NewEncoder(w).Encode(&gmail.ListHistoryResponse{
+					History: []*gmail.History{
+						{MessagesAdded: []*gmail.HistoryMessageAdded{{Message: &gmail.Message{Id: "m1"}}}},
+					},
+					NextPageToken: "page2",
+				})
+				return
+			}
+			json.NewEncoder(w).Encode(&gmail.ListHistoryResponse{
+				History: []*gmail.History{
+					// m1 resurfaces in the second page (e.g. relabeled); it
+					// must only be fetched and returned once.
+					{MessagesAdded: []*gmail.HistoryMessageAdded{
+						{Message: &gmail.Message{Id: "m1"}},
+						{Message: &gmail.Message{Id: "m2"}},
+					}},
+				},
+				HistoryId: 200,
+			})
+		case strings.HasSuffix(r.URL.Path, "/messages/m1"):
+			json.NewEncoder(w).Encode(&gmail.Message{Id: "m1"})
+		case strings.HasSuffix(r.URL.Path, "/messages/m2"):
+			json.NewEncoder(w).Encode(&gmail.Message{Id: "m2"})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	state := &syncState{HistoryId: 100, MessageIds: make(map[string]bool)}
+	messages, err := incrementalSync(srv, listOpts{}, state, FetchConfig{})
+	if err != nil {
+		t.Fatalf("incrementalSync: %v", err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("incrementalSync messages = %+v, want m1 and m2 with no duplicate", messages)
+	}
+	if state.HistoryId != 200 {
+		t.Fatalf("state.HistoryId = %d, want 200", state.HistoryId)
+	}
+}
+
+func TestIncrementalSyncFallsBackOnExpiredHistory(t *testing.T) {
+	srv := newFakeGmailService(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/history"):
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]any{"error": map[string]any{"code": 404, "message": "historyId expired"}})
+		case strings.HasSuffix(r.URL.Path, "/profile"):
+			json.NewEncoder(w).Encode(&gmail.Profile{HistoryId: 999})
+		case strings.HasSuffix(r.URL.Path, "/messages"):
+			json.NewEncoder(w).Encode(&gmail.ListMessagesResponse{Messages: []*gmail.Message{{Id: "m1"}}})
+		case strings.HasSuffix(r.URL.Path, "/messages/m1"):
+			json.NewEncoder(w).Encode(&gmail.Message{Id: "m1"})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	state := &syncState{HistoryId: 100, MessageIds: make(map[string]bool)}
+	messages, err := incrementalSync(srv, listOpts{}, state, FetchConfig{})
+	if err != nil {
+		t.Fatalf("incrementalSync: %v", err)
+	}
+	if len(messages) != 1 || messages[0].Id != "m1" {
+		t.Fatalf("incrementalSync fallback messages = %+v, want [m1] from the full sync", messages)
+	}
+	if state.HistoryId != 999 {
+		t.Fatalf("state.HistoryId = %d, want 999 (the fullSync fallback's baseline)", state.HistoryId)
+	}
+}
+
+func TestDownloadIncrementalSkipsAlreadyDownloadedMessages(t *testing.T) {
+	var attachmentFetches int32
+
+	srv := newFakeGmailService(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/history"):
+			json.NewEncoder(w).Encode(&gmail.ListHistoryResponse{
+				History: []*gmail.History{
+					{MessagesAdded: []*gmail.HistoryMessageAdded{
+						{Message: &gmail.Message{Id: "m1"}},
+						{Message: &gmail.Message{Id: "m2"}},
+					}},
+				},
+				HistoryId: 101,
+			})
+		case strings.HasSuffix(r.URL.Path, "/messages/m1"):
+			json.NewEncoder(w).Encode(messageWithAttachment("m1", "a1"))
+		case strings.HasSuffix(r.URL.Path, "/messages/m2"):
+			json.NewEncoder(w).Encode(messageWithAttachment("m2", "a2"))
+		case strings.Contains(r.URL.Path, "/attachments/"):
+			atomic.AddInt32(&attachmentFetches, 1)
+			json.NewEncoder(w).Encode(&gmail.MessagePartBody{Data: "aGVsbG8="})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	home := t.TempDir()
+	t.Setenv(ENV_HOME_VAR, home)
+
+	opts := listOpts{LabelId: "L1"}
+	if err := saveSyncState(syncKey(opts), &syncState{HistoryId: 100, MessageIds: map[string]bool{"m1": true}}); err != nil {
+		t.Fatalf("saveSyncState: %v", err)
+	}
+
+	downloadIncremental(srv, opts, NewFSSink(home), "", false, FetchConfig{})
+
+	if got := atomic.LoadInt32(&attachmentFetches); got != 1 {
+		t.Fatalf("attachment fetches = %d, want 1 (m1 was already downloaded and should be skipped)", got)
+	}
+
+	state, err := loadSyncState(syncKey(opts))
+	if err != nil {
+		t.Fatalf("loadSyncState: %v", err)
+	}
+	if !state.MessageIds["m1"] || !state.MessageIds["m2"] {
+		t.Fatalf("state.MessageIds = %+v, want both m1 and m2 recorded", state.MessageIds)
+	}
+	if state.HistoryId != 101 {
+		t.Fatalf("state.HistoryId = %d, want 101", state.HistoryId)
+	}
+}
+
+func messageWithAttachment(id, attachmentId string) *gmail.Message {
+	return &gmail.Message{
+		Id: id,
+		Payload: &gmail.MessagePart{
+			MimeType: "multipart/mixed",
+			Parts: []*gmail.MessagePart{
+				{
+					MimeType: "application/pdf",
+					Filename: "report.pdf",
+					Body:     &gmail.MessagePartBody{AttachmentId: attachmentId},
+				},
+			},
+		},
+	}
+}